@@ -0,0 +1,71 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+
+	"github.com/google/zoekt/query"
+)
+
+// EvalDocIDs returns, in ascending order and without duplicates, the
+// docIDs of b's documents that match q. It understands query.PathPrefix,
+// evaluated against b's subRepoTree via DocIDsWithPathPrefix, and
+// query.And, whose children are evaluated and intersected. There is no
+// other query node in this package yet that produces a candidate docID
+// set, so any other query.Q is rejected.
+func (b *IndexBuilder) EvalDocIDs(q query.Q) ([]uint32, error) {
+	switch q := q.(type) {
+	case *query.PathPrefix:
+		return b.DocIDsWithPathPrefix(q.Prefix), nil
+	case *query.And:
+		if len(q.Children) == 0 {
+			return nil, nil
+		}
+		result, err := b.EvalDocIDs(q.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range q.Children[1:] {
+			next, err := b.EvalDocIDs(c)
+			if err != nil {
+				return nil, err
+			}
+			result = intersectSorted(result, next)
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("zoekt: EvalDocIDs does not support %T", q)
+	}
+}
+
+// intersectSorted returns the sorted intersection of two ascending,
+// duplicate-free docID slices.
+func intersectSorted(a, b []uint32) []uint32 {
+	var out []uint32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/zoekt/query"
+)
+
+func TestEvalDocIDsPathPrefixAndAnd(t *testing.T) {
+	repo := &Repository{
+		SubRepoMap: map[string]*Repository{
+			"a/b":  {},
+			"a/bb": {},
+		},
+	}
+	b, err := NewIndexBuilder(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs := []Document{
+		{Name: "a/b/1.txt", Content: []byte("x"), SubRepositoryPath: "a/b"},
+		{Name: "a/bb/2.txt", Content: []byte("x"), SubRepositoryPath: "a/bb"},
+		{Name: "a/b/3.txt", Content: []byte("x"), SubRepositoryPath: "a/b"},
+	}
+	for _, d := range docs {
+		if err := b.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := b.EvalDocIDs(&query.PathPrefix{Prefix: "a/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "a/b" is a directory prefix: it must not also select the
+	// sibling subrepo "a/bb".
+	if want := []uint32{0, 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("PathPrefix(a/b) = %v, want %v", got, want)
+	}
+
+	got, err = b.EvalDocIDs(&query.And{Children: []query.Q{
+		&query.PathPrefix{Prefix: "a"},
+		&query.PathPrefix{Prefix: "a/b"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{0, 2}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("And(a, a/b) = %v, want %v", got, want)
+	}
+}
+
+func TestIntersectSorted(t *testing.T) {
+	cases := []struct {
+		a, b, want []uint32
+	}{
+		{nil, nil, nil},
+		{[]uint32{1, 2, 3}, []uint32{2, 3, 4}, []uint32{2, 3}},
+		{[]uint32{1, 2}, []uint32{3, 4}, nil},
+		{[]uint32{1, 2, 3}, []uint32{1, 2, 3}, []uint32{1, 2, 3}},
+	}
+	for _, c := range cases {
+		got := intersectSorted(c.a, c.b)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("intersectSorted(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
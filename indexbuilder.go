@@ -50,16 +50,31 @@ type postingsBuilder struct {
 
 	endRunes []uint32
 	endByte  uint32
+
+	// budget is shared with the sibling postingsBuilder (contents and
+	// names) of the same IndexBuilder, so a BuilderOptions.MaxInMemoryBytes
+	// budget bounds their combined footprint. Nil disables spilling.
+	budget *memBudget
+
+	// curBytes tracks the footprint of postings contributed by this
+	// builder since its last spill (or since it was created); it is
+	// what gets handed back to budget when this builder spills.
+	curBytes int64
+
+	// segments holds the paths of segment files written so far, in
+	// the order they were spilled (oldest first).
+	segments []string
 }
 
-func newPostingsBuilder() *postingsBuilder {
+func newPostingsBuilder(budget *memBudget) *postingsBuilder {
 	return &postingsBuilder{
 		postings:    map[ngram][]byte{},
 		lastOffsets: map[ngram]uint32{},
+		budget:      budget,
 	}
 }
 
-func (s *postingsBuilder) newSearchableString(data []byte) *searchableString {
+func (s *postingsBuilder) newSearchableString(data []byte) (*searchableString, error) {
 	dest := searchableString{
 		data: data,
 	}
@@ -67,6 +82,7 @@ func (s *postingsBuilder) newSearchableString(data []byte) *searchableString {
 	var runeGram [3]rune
 
 	runeIndex := -1
+	var exceeded bool
 
 	dataSz := uint32(len(data))
 	i := 0
@@ -96,11 +112,19 @@ func (s *postingsBuilder) newSearchableString(data []byte) *searchableString {
 		m := binary.PutUvarint(buf[:], uint64(newOff-lastOff))
 		s.postings[ng] = append(s.postings[ng], buf[:m]...)
 		s.lastOffsets[ng] = newOff
+		s.curBytes += int64(m)
+		exceeded = exceeded || s.budget.add(int64(m))
 	}
 
 	s.endRunes = append(s.endRunes, s.runeCount)
 	s.endByte += dataSz
-	return &dest
+
+	if exceeded {
+		if err := s.spill(); err != nil {
+			return nil, err
+		}
+	}
+	return &dest, nil
 }
 
 // IndexBuilder builds a single index shard.
@@ -123,6 +147,15 @@ type IndexBuilder struct {
 
 	// name to index.
 	subRepoIndices map[string]uint32
+
+	// subRepoTree answers PathPrefix queries against subRepoIndices
+	// without scanning every path.
+	subRepoTree *subRepoTree
+
+	// subRepoDocs maps a subRepoIdx to the docIDs added under it, so
+	// a PathPrefix match can be turned into a docID set without
+	// scanning every document.
+	subRepoDocs map[uint32][]uint32
 }
 
 func (d *Repository) verify() error {
@@ -141,12 +174,29 @@ func (b *IndexBuilder) ContentSize() uint32 {
 	return b.contentEnd + b.nameEnd
 }
 
+// BuilderOptions holds tunables for IndexBuilder construction.
+type BuilderOptions struct {
+	// MaxInMemoryBytes bounds the combined size of the in-memory
+	// content and filename postings before they are spilled to a
+	// temporary on-disk segment file. Zero (the default) disables
+	// spilling, so postings are kept in memory for the life of the
+	// builder, matching the historical behavior.
+	MaxInMemoryBytes int64
+}
+
 // NewIndexBuilder creates a fresh IndexBuilder. The passed in
 // Repository contains repo metadata, and may be set to nil.
 func NewIndexBuilder(r *Repository) (*IndexBuilder, error) {
+	return NewIndexBuilderWithOptions(r, BuilderOptions{})
+}
+
+// NewIndexBuilderWithOptions creates a fresh IndexBuilder with the
+// given memory budget. See BuilderOptions for details.
+func NewIndexBuilderWithOptions(r *Repository, opts BuilderOptions) (*IndexBuilder, error) {
+	budget := &memBudget{max: opts.MaxInMemoryBytes}
 	b := &IndexBuilder{
-		contents: newPostingsBuilder(),
-		names:    newPostingsBuilder(),
+		contents: newPostingsBuilder(budget),
+		names:    newPostingsBuilder(budget),
 	}
 
 	if r == nil {
@@ -278,6 +328,22 @@ func (b *IndexBuilder) populateSubRepoIndices() {
 	for i, p := range paths {
 		b.subRepoIndices[p] = uint32(i)
 	}
+	b.subRepoTree = newSubRepoTree(b.subRepoIndices)
+}
+
+// DocIDsWithPathPrefix returns, in ascending order, the docIDs of
+// every document whose SubRepositoryPath is prefix or lies under it.
+// It is the evaluation primitive for the query.PathPrefix node: the
+// prefix is resolved against subRepoTree to a set of subRepoIdx
+// values, which is then expanded to docIDs via subRepoDocs, without
+// scanning every document in the shard.
+func (b *IndexBuilder) DocIDsWithPathPrefix(prefix string) []uint32 {
+	var docs []uint32
+	for _, idx := range b.subRepoTree.pathsWithPrefix(prefix) {
+		docs = append(docs, b.subRepoDocs[idx]...)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i] < docs[j] })
+	return docs
 }
 
 // Add a file which only occurs in certain branches. The document
@@ -316,11 +382,21 @@ func (b *IndexBuilder) Add(doc Document) error {
 	}
 
 	b.subRepos = append(b.subRepos, subRepoIdx)
+	if b.subRepoDocs == nil {
+		b.subRepoDocs = map[uint32][]uint32{}
+	}
+	b.subRepoDocs[subRepoIdx] = append(b.subRepoDocs[subRepoIdx], uint32(len(b.subRepos)-1))
 
-	docStr := b.contents.newSearchableString(doc.Content)
+	docStr, err := b.contents.newSearchableString(doc.Content)
+	if err != nil {
+		return err
+	}
 	b.files = append(b.files, docStr)
 
-	nameStr := b.names.newSearchableString([]byte(doc.Name))
+	nameStr, err := b.names.newSearchableString([]byte(doc.Name))
+	if err != nil {
+		return err
+	}
 	b.fileNames = append(b.fileNames, nameStr)
 	b.docSections = append(b.docSections, doc.Symbols)
 
@@ -328,6 +404,32 @@ func (b *IndexBuilder) Add(doc Document) error {
 	return nil
 }
 
+// Finish must be called after all documents have been added and
+// before the shard is written out. It merges any postings segments
+// that were spilled to disk because of a BuilderOptions.MaxInMemoryBytes
+// budget back into a single in-memory postings map, and removes the
+// temporary segment files. Finish is a no-op if nothing was spilled.
+func (b *IndexBuilder) Finish() error {
+	if err := b.contents.finish(); err != nil {
+		return err
+	}
+	return b.names.finish()
+}
+
+// Close removes any postings segments that have been spilled to disk
+// without merging them. Callers that abandon a build after one or
+// more calls to Add (for example because a later Add or the overall
+// indexing run failed) must call Close, or a spill made under a
+// BuilderOptions.MaxInMemoryBytes budget leaks its temporary segment
+// file. A build that completes normally should call Finish instead,
+// which also cleans up the segment files as part of merging them.
+func (b *IndexBuilder) Close() error {
+	if err := b.contents.discardSegments(); err != nil {
+		return err
+	}
+	return b.names.discardSegments()
+}
+
 func (b *IndexBuilder) branchMask(br string) uint32 {
 	for i, b := range b.repo.Branches {
 		if b.Name == br {
@@ -0,0 +1,327 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// memBudget tracks postings memory usage shared by the content and
+// filename postingsBuilders of a single IndexBuilder, so that
+// BuilderOptions.MaxInMemoryBytes bounds their combined footprint
+// rather than giving each builder the full budget independently.
+type memBudget struct {
+	max  int64
+	used int64
+}
+
+// add records n more bytes of postings as used, and reports whether
+// the combined usage has reached or exceeded the budget.
+func (m *memBudget) add(n int64) bool {
+	if m == nil {
+		return false
+	}
+	m.used += n
+	return m.max > 0 && m.used >= m.max
+}
+
+// free gives back n bytes, typically after a builder spills its
+// postings to disk and drops its in-memory copy.
+func (m *memBudget) free(n int64) {
+	if m == nil {
+		return
+	}
+	m.used -= n
+}
+
+// spill writes the current postings map to a temporary on-disk
+// segment, sorted by ngram, then resets the in-memory maps so
+// indexing can continue within the memory budget. Each entry is
+// written as the ngram (8 bytes, big endian), a varint byte count,
+// and the raw delta-encoded offset bytes for that ngram.
+func (s *postingsBuilder) spill() error {
+	f, err := ioutil.TempFile("", "zoekt-postings-*.seg")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := make([]ngram, 0, len(s.postings))
+	for k := range s.postings {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	w := bufio.NewWriter(f)
+	var hdr [8]byte
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, k := range keys {
+		binary.BigEndian.PutUint64(hdr[:], uint64(k))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+
+		blob := s.postings[k]
+		n := binary.PutUvarint(lenBuf[:], uint64(len(blob)))
+		if _, err := w.Write(lenBuf[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(blob); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	s.budget.free(s.curBytes)
+	s.segments = append(s.segments, f.Name())
+	s.postings = map[ngram][]byte{}
+	s.lastOffsets = map[ngram]uint32{}
+	s.curBytes = 0
+	return nil
+}
+
+// finish merges any spilled segments together with the remaining
+// in-memory postings into a single map, and removes the segment
+// files. It is a no-op if nothing was ever spilled.
+func (s *postingsBuilder) finish() error {
+	if len(s.segments) == 0 {
+		return nil
+	}
+
+	runs := make([]postingsRun, 0, len(s.segments)+1)
+	for _, p := range s.segments {
+		r, err := newSegmentRun(p)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, r)
+	}
+	runs = append(runs, newMemRun(s.postings))
+
+	merged, mergeErr := mergeRuns(runs)
+
+	for _, r := range runs {
+		r.close()
+	}
+	s.discardSegments()
+	if mergeErr != nil {
+		return mergeErr
+	}
+
+	s.postings = merged
+	return nil
+}
+
+// discardSegments removes any segment files spilled so far, without
+// merging them, and forgets about them. Call it to avoid leaking the
+// temporary files when a build is abandoned after one or more spills
+// (for example because a later Add fails); a build that runs to
+// completion instead calls finish, which merges the segments before
+// discarding them.
+func (s *postingsBuilder) discardSegments() error {
+	var firstErr error
+	for _, p := range s.segments {
+		if err := os.Remove(p); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.segments = nil
+	return firstErr
+}
+
+// postingsRun is one sorted-by-ngram source of postings entries, fed
+// into the k-way merge in mergeRuns: either a segment file spilled
+// earlier, or the builder's final in-memory map.
+type postingsRun interface {
+	// next returns the next (ngram, raw postings blob) pair in
+	// ascending ngram order, or ok == false once the run is
+	// exhausted.
+	next() (ng ngram, blob []byte, ok bool, err error)
+	close() error
+}
+
+type segmentRun struct {
+	f *os.File
+	r *bufio.Reader
+}
+
+func newSegmentRun(path string) (*segmentRun, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentRun{f: f, r: bufio.NewReader(f)}, nil
+}
+
+func (s *segmentRun) next() (ngram, []byte, bool, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, false, nil
+		}
+		return 0, nil, false, err
+	}
+	ng := ngram(binary.BigEndian.Uint64(hdr[:]))
+
+	n, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	blob := make([]byte, n)
+	if _, err := io.ReadFull(s.r, blob); err != nil {
+		return 0, nil, false, err
+	}
+	return ng, blob, true, nil
+}
+
+func (s *segmentRun) close() error {
+	return s.f.Close()
+}
+
+// memRun presents the tail in-memory postings map, sorted by ngram,
+// as a postingsRun.
+type memRun struct {
+	keys []ngram
+	m    map[ngram][]byte
+	i    int
+}
+
+func newMemRun(m map[ngram][]byte) *memRun {
+	keys := make([]ngram, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return &memRun{keys: keys, m: m}
+}
+
+func (r *memRun) next() (ngram, []byte, bool, error) {
+	if r.i >= len(r.keys) {
+		return 0, nil, false, nil
+	}
+	k := r.keys[r.i]
+	r.i++
+	return k, r.m[k], true, nil
+}
+
+func (r *memRun) close() error { return nil }
+
+type postingsHeapItem struct {
+	ng     ngram
+	blob   []byte
+	runIdx int
+}
+
+// postingsHeap orders items by ngram, and breaks ties between runs
+// sharing an ngram by run index, so that entries for one ngram are
+// always merged oldest-run-first.
+type postingsHeap []postingsHeapItem
+
+func (h postingsHeap) Len() int      { return len(h) }
+func (h postingsHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h postingsHeap) Less(i, j int) bool {
+	if h[i].ng != h[j].ng {
+		return h[i].ng < h[j].ng
+	}
+	return h[i].runIdx < h[j].runIdx
+}
+func (h *postingsHeap) Push(x interface{}) { *h = append(*h, x.(postingsHeapItem)) }
+func (h *postingsHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	*h = old[:n-1]
+	return it
+}
+
+// mergeRuns performs a k-way merge of runs, which must be ordered
+// oldest to newest (the order in which they were spilled, with the
+// final in-memory map last). For ngrams that appear in more than one
+// run, the first delta of each later run is rebased against the last
+// absolute offset recorded by the run before it, so the concatenated
+// byte stream remains a valid sequence of deltas.
+func mergeRuns(runs []postingsRun) (map[ngram][]byte, error) {
+	h := &postingsHeap{}
+	heap.Init(h)
+	for i, r := range runs {
+		ng, blob, ok, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			heap.Push(h, postingsHeapItem{ng: ng, blob: blob, runIdx: i})
+		}
+	}
+
+	out := map[ngram][]byte{}
+	lastAbs := map[ngram]uint32{}
+
+	for h.Len() > 0 {
+		it := heap.Pop(h).(postingsHeapItem)
+
+		rebased, abs, err := rebaseBlob(it.blob, lastAbs[it.ng])
+		if err != nil {
+			return nil, err
+		}
+		out[it.ng] = append(out[it.ng], rebased...)
+		lastAbs[it.ng] = abs
+
+		ng, blob, ok, err := runs[it.runIdx].next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			heap.Push(h, postingsHeapItem{ng: ng, blob: blob, runIdx: it.runIdx})
+		}
+	}
+	return out, nil
+}
+
+// rebaseBlob rewrites the leading delta of blob so that it is
+// relative to prevAbs, the last absolute offset recorded for this
+// ngram by an earlier run (0 if this is the first run to contain the
+// ngram). It returns the rewritten blob, and the new last absolute
+// offset after applying every delta in blob.
+func rebaseBlob(blob []byte, prevAbs uint32) ([]byte, uint32, error) {
+	first, n := binary.Uvarint(blob)
+	if n <= 0 {
+		return nil, 0, fmt.Errorf("postings segment: corrupt varint")
+	}
+	firstOff := uint32(first)
+
+	var buf [binary.MaxVarintLen64]byte
+	m := binary.PutUvarint(buf[:], uint64(firstOff-prevAbs))
+	out := append(append([]byte{}, buf[:m]...), blob[n:]...)
+
+	abs := firstOff
+	for rest := blob[n:]; len(rest) > 0; {
+		d, sz := binary.Uvarint(rest)
+		if sz <= 0 {
+			return nil, 0, fmt.Errorf("postings segment: corrupt varint")
+		}
+		abs += uint32(d)
+		rest = rest[sz:]
+	}
+	return out, abs, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// withSpill builds b from docs under a tight memory budget and
+// returns it once Finish has merged every spilled segment back in.
+func withSpill(t *testing.T, maxInMemoryBytes int64, docs []Document) *IndexBuilder {
+	t.Helper()
+
+	b, err := NewIndexBuilderWithOptions(nil, BuilderOptions{MaxInMemoryBytes: maxInMemoryBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range docs {
+		if err := b.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSpillMergeMatchesUnbudgeted(t *testing.T) {
+	docs := []Document{
+		{Name: "a", Content: []byte("hello world foo bar")},
+		{Name: "b", Content: []byte("another line of text entirely")},
+		{Name: "c", Content: []byte("foo bar baz qux quux corge grault")},
+	}
+
+	spilled := withSpill(t, 20, docs)
+	if len(spilled.contents.segments) != 0 {
+		t.Fatalf("segments should be empty after Finish, got %v", spilled.contents.segments)
+	}
+
+	unbudgeted, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range docs {
+		if err := unbudgeted.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(spilled.contents.postings, unbudgeted.contents.postings) {
+		t.Fatalf("postings differ after spill+merge:\n got  %v\n want %v", spilled.contents.postings, unbudgeted.contents.postings)
+	}
+}
+
+func TestMaxInMemoryBytesBoundsCombinedBudget(t *testing.T) {
+	// A single shared postingsBuilder budget of 40 bytes should
+	// trigger a spill well before either contents or names alone
+	// would hit a 40-byte budget on its own.
+	b, err := NewIndexBuilderWithOptions(nil, BuilderOptions{MaxInMemoryBytes: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(Document{Name: "some/long/file/name/to/pad/out/names/postings.go", Content: []byte("abcdefghijklmnopqrstuvwxyz0123456789")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.contents.budget != b.names.budget {
+		t.Fatalf("contents and names postingsBuilders must share one memBudget")
+	}
+	if len(b.contents.segments) == 0 && len(b.names.segments) == 0 {
+		t.Fatalf("expected at least one spill from either builder under the shared budget")
+	}
+}
+
+func TestCloseRemovesSpilledSegments(t *testing.T) {
+	b, err := NewIndexBuilderWithOptions(nil, BuilderOptions{MaxInMemoryBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(Document{Name: "a", Content: []byte("some reasonably long content to force a spill")}); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := append([]string{}, b.contents.segments...)
+	segments = append(segments, b.names.segments...)
+	if len(segments) == 0 {
+		t.Fatal("expected at least one spilled segment file")
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range segments {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("segment file %s should have been removed by Close, stat err: %v", p, err)
+		}
+	}
+}
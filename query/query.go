@@ -0,0 +1,57 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package query holds the query tree nodes accepted by zoekt
+// searches.
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Q is a node in a search query tree.
+type Q interface {
+	String() string
+}
+
+// PathPrefix restricts results to documents whose SubRepositoryPath
+// is Prefix or lies under it, e.g. "search within directory X". A
+// shard evaluates it against its subRepoTree to collect the matching
+// subRepoIdx set and turns that into a docID set via
+// IndexBuilder.DocIDsWithPathPrefix. IndexBuilder.EvalDocIDs
+// intersects that set with the docID sets of the other children of
+// an enclosing And; no posting lists are consulted.
+type PathPrefix struct {
+	Prefix string
+}
+
+func (p *PathPrefix) String() string {
+	return fmt.Sprintf("path_prefix:%q", p.Prefix)
+}
+
+// And is the conjunction of Children: a document matches only if it
+// matches every child. See IndexBuilder.EvalDocIDs for how a shard
+// turns this into a docID set.
+type And struct {
+	Children []Q
+}
+
+func (q *And) String() string {
+	parts := make([]string, 0, len(q.Children))
+	for _, c := range q.Children {
+		parts = append(parts, c.String())
+	}
+	return "(and " + strings.Join(parts, " ") + ")"
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// subRepoNode is one node of a subRepoTree: a compressed (radix)
+// trie edge labeled with the path bytes it covers, plus an optional
+// subRepoIdx if a subrepo path ends exactly at this node.
+type subRepoNode struct {
+	label    string
+	idx      uint32
+	hasIdx   bool
+	children []*subRepoNode
+}
+
+// subRepoTree is a radix tree over subrepo paths, built once from
+// IndexBuilder.subRepoIndices, that answers "which subrepos lie under
+// this path prefix" in time proportional to the prefix length plus
+// the number of matches, rather than the total number of subrepos.
+type subRepoTree struct {
+	root *subRepoNode
+}
+
+// newSubRepoTree builds a subRepoTree from the given path->idx
+// mapping, e.g. IndexBuilder.subRepoIndices.
+func newSubRepoTree(indices map[string]uint32) *subRepoTree {
+	paths := make([]string, 0, len(indices))
+	for p := range indices {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	t := &subRepoTree{root: &subRepoNode{}}
+	for _, p := range paths {
+		t.insert(p, indices[p])
+	}
+	return t
+}
+
+func commonPrefixLen(a, b string) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func (t *subRepoTree) insert(path string, idx uint32) {
+	n := t.root
+walk:
+	for path != "" {
+		for i, c := range n.children {
+			cp := commonPrefixLen(c.label, path)
+			if cp == 0 {
+				continue
+			}
+			if cp == len(c.label) {
+				n = c
+				path = path[cp:]
+				continue walk
+			}
+
+			// path and c.label share a prefix shorter than
+			// c.label: split c into a new intermediate node.
+			mid := &subRepoNode{label: c.label[:cp], children: []*subRepoNode{c}}
+			c.label = c.label[cp:]
+			n.children[i] = mid
+			n = mid
+			path = path[cp:]
+			continue walk
+		}
+
+		leaf := &subRepoNode{label: path}
+		n.children = append(n.children, leaf)
+		n = leaf
+		path = ""
+	}
+	n.idx = idx
+	n.hasIdx = true
+}
+
+// pathsWithPrefix returns the subRepoIdx values of every subrepo path
+// under the directory prefix, including prefix itself if it names a
+// subrepo. Matching is component-aware: prefix "a/b" selects "a/b"
+// and anything below it like "a/b/c", but not the sibling "a/bb",
+// since that isn't a path underneath directory "a/b". An empty
+// prefix selects every subrepo.
+func (t *subRepoTree) pathsWithPrefix(prefix string) []uint32 {
+	if prefix == "" {
+		return collectIndices(t.root)
+	}
+
+	n := t.root
+	rest := prefix
+	for rest != "" {
+		var next *subRepoNode
+		for _, c := range n.children {
+			cp := commonPrefixLen(c.label, rest)
+			if cp == 0 {
+				continue
+			}
+			if cp == len(rest) {
+				if cp == len(c.label) {
+					// prefix ends exactly at this node: it, plus
+					// anything reached through a path-separator
+					// boundary below it, is under prefix.
+					next = c
+					rest = ""
+					break
+				}
+				// prefix ends partway through this edge: only a
+				// match if the very next byte starts a new path
+				// component, so "a/b" doesn't also select "a/bb".
+				if c.label[cp] == '/' {
+					return collectIndices(c)
+				}
+				return nil
+			}
+			if cp == len(c.label) {
+				next = c
+				rest = rest[cp:]
+				break
+			}
+			// prefix diverges partway through the edge: no subrepo
+			// under it can match.
+			return nil
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+
+	return collectAtDirBoundary(n)
+}
+
+// collectAtDirBoundary collects n itself (n is an exact match for the
+// directory prefix) plus every descendant reached through a child
+// whose edge starts with a path separator -- i.e. true subdirectories
+// of prefix, as opposed to sibling paths like "a/bb" that merely
+// share the raw bytes "a/b" with no separator in between.
+func collectAtDirBoundary(n *subRepoNode) []uint32 {
+	var out []uint32
+	if n.hasIdx {
+		out = append(out, n.idx)
+	}
+	for _, c := range n.children {
+		if strings.HasPrefix(c.label, "/") {
+			out = append(out, collectIndices(c)...)
+		}
+	}
+	return out
+}
+
+// collectIndices gathers every subRepoIdx at or below n, walking n's
+// immediate children concurrently (one goroutine per top-level
+// branch) and then recursing sequentially, so a prefix near the root
+// of a shard with many subrepos doesn't spawn a goroutine per tree
+// node.
+func collectIndices(n *subRepoNode) []uint32 {
+	var out []uint32
+	if n.hasIdx {
+		out = append(out, n.idx)
+	}
+	if len(n.children) == 0 {
+		return out
+	}
+
+	results := make([][]uint32, len(n.children))
+	var wg sync.WaitGroup
+	for i, c := range n.children {
+		wg.Add(1)
+		go func(i int, c *subRepoNode) {
+			defer wg.Done()
+			results[i] = collectIndicesSequential(c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, r := range results {
+		out = append(out, r...)
+	}
+	return out
+}
+
+// collectIndicesSequential is collectIndices without further
+// concurrent fan-out; it is used below the top level that
+// collectIndices itself parallelizes.
+func collectIndicesSequential(n *subRepoNode) []uint32 {
+	var out []uint32
+	if n.hasIdx {
+		out = append(out, n.idx)
+	}
+	for _, c := range n.children {
+		out = append(out, collectIndicesSequential(c)...)
+	}
+	return out
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func sortedUint32(xs []uint32) []uint32 {
+	out := append([]uint32{}, xs...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func TestSubRepoTreePathsWithPrefix(t *testing.T) {
+	indices := map[string]uint32{
+		"a":     0,
+		"a/b":   1,
+		"a/bb":  2,
+		"a/b/c": 3,
+		"x":     4,
+	}
+	tr := newSubRepoTree(indices)
+
+	cases := []struct {
+		prefix string
+		want   []uint32
+	}{
+		// "a/b" is a directory prefix: it matches itself and the
+		// nested "a/b/c", but not the sibling "a/bb", which merely
+		// shares the raw bytes "a/b" with no separator in between.
+		{"a/b", []uint32{1, 3}},
+		{"a/bb", []uint32{2}},
+		{"a/b/c", []uint32{3}},
+		{"a", []uint32{0, 1, 2, 3}},
+		{"x", []uint32{4}},
+		{"nope", nil},
+		{"", []uint32{0, 1, 2, 3, 4}},
+	}
+
+	for _, c := range cases {
+		got := sortedUint32(tr.pathsWithPrefix(c.prefix))
+		want := sortedUint32(c.want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("pathsWithPrefix(%q) = %v, want %v", c.prefix, got, want)
+		}
+	}
+}
+
+func TestSubRepoTreeSplitsSharedEdge(t *testing.T) {
+	// Inserting "team/beta" after "team/alpha" forces a split of the
+	// "team/alpha" edge at their shared prefix "team/", exercising the
+	// mid-edge split branch of insert.
+	indices := map[string]uint32{
+		"team/alpha": 0,
+		"team/beta":  1,
+	}
+	tr := newSubRepoTree(indices)
+
+	if got := sortedUint32(tr.pathsWithPrefix("team")); !reflect.DeepEqual(got, []uint32{0, 1}) {
+		t.Fatalf("pathsWithPrefix(\"team\") = %v, want [0 1]", got)
+	}
+	if got := sortedUint32(tr.pathsWithPrefix("team/alpha")); !reflect.DeepEqual(got, []uint32{0}) {
+		t.Fatalf("pathsWithPrefix(\"team/alpha\") = %v, want [0]", got)
+	}
+	if got := tr.pathsWithPrefix("team/a/nope"); got != nil {
+		t.Fatalf("pathsWithPrefix(\"team/a/nope\") = %v, want nil", got)
+	}
+}
+
+// TestCollectIndicesFansOutOnlyAtTopLevel guards against collectIndices
+// going back to spawning a goroutine per tree node: a single deep chain
+// of nested directories (each level holds one leaf subrepo and the next
+// directory, the shape a "fan out per node" implementation handles
+// worst) must not leave behind anywhere near
+// one goroutine per path component.
+func TestCollectIndicesFansOutOnlyAtTopLevel(t *testing.T) {
+	const depth = 5000
+	indices := map[string]uint32{}
+	path := ""
+	for i := 0; i < depth; i++ {
+		path += fmt.Sprintf("d%d/", i)
+		indices[path+"leaf"] = uint32(i)
+	}
+	tr := newSubRepoTree(indices)
+
+	before := runtime.NumGoroutine()
+	got := tr.pathsWithPrefix("")
+	after := runtime.NumGoroutine()
+
+	if len(got) != depth {
+		t.Fatalf("pathsWithPrefix(\"\") returned %d indices, want %d", len(got), depth)
+	}
+	// Only the root's own (single) top-level branch should have
+	// spawned a goroutine; a one-goroutine-per-node implementation
+	// would have spun up on the order of depth goroutines instead.
+	if after-before > 10 {
+		t.Fatalf("goroutine count grew by %d walking a chain of depth %d; collectIndices should only fan out at the top level", after-before, depth)
+	}
+}
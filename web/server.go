@@ -0,0 +1,159 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+)
+
+// Searcher is the minimal search interface the REST handler needs.
+// It is satisfied by zoekt.ShardedSearcher.
+type Searcher interface {
+	Search(query string) (*SearchResult, error)
+}
+
+// SearchResult and FileMatch mirror the fields of zoekt's native
+// match structs that the REST API exposes; the structured format in
+// structured.go re-expresses their highlighted attributes as Match
+// values instead.
+type SearchResult struct {
+	Files []FileMatch
+}
+
+type FileMatch struct {
+	FileName       string
+	FileNameRanges []HighlightRange
+	Lines          []LineMatch
+	Symbols        []SymbolMatch
+}
+
+type LineMatch struct {
+	Line   string
+	Ranges []HighlightRange
+}
+
+// SymbolMatch is a symbol (function, type, etc.) declared in the file
+// whose name matched one or more query terms.
+type SymbolMatch struct {
+	Name   string
+	Ranges []HighlightRange
+}
+
+// HighlightRange is a single highlighted span, in byte offsets, and
+// the query term that produced it.
+type HighlightRange struct {
+	Start, End int
+	Word       string
+}
+
+// Server serves the zoekt web UI and REST API.
+type Server struct {
+	Searcher Searcher
+	Top      *template.Template
+	Version  string
+
+	// Print enables local result URLs.
+	Print bool
+	// HTML enables the HTML interface.
+	HTML bool
+	// RESTAPI enables the JSON REST API, including the structured
+	// match format handled by serveSearchREST.
+	RESTAPI bool
+
+	HostCustomQueries map[string]string
+}
+
+// Top is the root HTML template; callers may override pieces of it
+// via --template_dir before serving.
+var Top = template.Must(template.New("top").Parse(""))
+
+// TemplateText holds the built-in template sources, keyed by
+// template name, for --dump_templates to write out for customization.
+var TemplateText = map[string]string{}
+
+// NewMux builds the HTTP handler for Server.
+func NewMux(s *Server) (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	if s.RESTAPI {
+		mux.HandleFunc("/api/search", s.serveSearchREST)
+	}
+	return mux, nil
+}
+
+// serveSearchREST is the REST API search endpoint registered by
+// NewMux. When the caller asks for the structured match format (see
+// wantsStructuredFormat), each hit's highlighted attributes are
+// rendered as Match values instead of zoekt's native match structs.
+func (s *Server) serveSearchREST(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+
+	result, err := s.Searcher.Search(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !wantsStructuredFormat(r) {
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	terms := queryTerms(q)
+	if err := json.NewEncoder(w).Encode(structuredResult(result, terms)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// structuredFile is one file's hit card in the structured format: a
+// Match for each of the four attributes the structured format
+// covers -- filename, path segments, line content, and symbol name.
+type structuredFile struct {
+	FileName     Match   `json:"fileName"`
+	PathSegments []Match `json:"pathSegments"`
+	Lines        []Match `json:"lines"`
+	Symbols      []Match `json:"symbols,omitempty"`
+}
+
+func structuredResult(result *SearchResult, terms []string) []structuredFile {
+	out := make([]structuredFile, 0, len(result.Files))
+	for _, f := range result.Files {
+		sf := structuredFile{
+			FileName:     newMatch(f.FileName, toByteRanges(f.FileNameRanges), len(terms)),
+			PathSegments: pathSegmentMatches(f.FileName, toByteRanges(f.FileNameRanges), len(terms)),
+		}
+		for _, l := range f.Lines {
+			sf.Lines = append(sf.Lines, newMatch(l.Line, toByteRanges(l.Ranges), len(terms)))
+		}
+		for _, sym := range f.Symbols {
+			sf.Symbols = append(sf.Symbols, newMatch(sym.Name, toByteRanges(sym.Ranges), len(terms)))
+		}
+		out = append(out, sf)
+	}
+	return out
+}
+
+func toByteRanges(rs []HighlightRange) []byteRange {
+	out := make([]byteRange, len(rs))
+	for i, r := range rs {
+		out[i] = byteRange{start: r.Start, end: r.End, word: r.Word}
+	}
+	return out
+}
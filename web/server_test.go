@@ -0,0 +1,53 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import "testing"
+
+func TestStructuredResultCoversAllFourAttributes(t *testing.T) {
+	result := &SearchResult{
+		Files: []FileMatch{
+			{
+				FileName:       "web/structured.go",
+				FileNameRanges: []HighlightRange{{Start: 4, End: 10, Word: "struct"}},
+				Lines: []LineMatch{
+					{Line: "func newMatch(...)", Ranges: []HighlightRange{{Start: 5, End: 13, Word: "newMatch"}}},
+				},
+				Symbols: []SymbolMatch{
+					{Name: "newMatch", Ranges: []HighlightRange{{Start: 0, End: 8, Word: "newMatch"}}},
+				},
+			},
+		},
+	}
+
+	out := structuredResult(result, []string{"struct", "newMatch"})
+	if len(out) != 1 {
+		t.Fatalf("got %d structured files, want 1", len(out))
+	}
+	sf := out[0]
+
+	if sf.FileName.Value != "web/structured.go" {
+		t.Fatalf("FileName.Value = %q", sf.FileName.Value)
+	}
+	if len(sf.PathSegments) != 2 {
+		t.Fatalf("got %d path segments, want 2: %+v", len(sf.PathSegments), sf.PathSegments)
+	}
+	if len(sf.Lines) != 1 || sf.Lines[0].MatchLevel == MatchLevelNone {
+		t.Fatalf("Lines = %+v, want one matched line", sf.Lines)
+	}
+	if len(sf.Symbols) != 1 || sf.Symbols[0].Value != "newMatch" || sf.Symbols[0].MatchLevel == MatchLevelNone {
+		t.Fatalf("Symbols = %+v, want one matched \"newMatch\" symbol", sf.Symbols)
+	}
+}
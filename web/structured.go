@@ -0,0 +1,222 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+// This file adds the structured match format to the REST API enabled
+// by --rest_api. serveSearchREST (server.go) checks
+// wantsStructuredFormat(r) and, if true, builds a Match per
+// highlighted attribute (filename, path segments, line content,
+// symbol name) via newMatch instead of emitting zoekt's native match
+// structs directly.
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// structuredAcceptHeader is the content type that selects the
+// structured match format, as an alternative to ?format=structured.
+const structuredAcceptHeader = "application/vnd.zoekt.v2+json"
+
+// wantsStructuredFormat reports whether the REST request asked for
+// the structured match format, either via the format query parameter
+// or the Accept header.
+func wantsStructuredFormat(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "structured" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), structuredAcceptHeader)
+}
+
+// queryTerms splits a zoekt query string into the distinct terms used
+// to decide MatchLevel. This is deliberately simple (whitespace
+// splitting) rather than a full query parse, since this package does
+// not have access to zoekt's query parser.
+func queryTerms(q string) []string {
+	fields := strings.Fields(q)
+	seen := make(map[string]bool, len(fields))
+	var terms []string
+	for _, f := range fields {
+		if !seen[f] {
+			seen[f] = true
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+// pathSegmentMatches splits fileName into one Match per "/"-separated
+// path segment (e.g. "a/b/c.go" -> "a", "b", "c.go"), so a frontend
+// can render or link each breadcrumb independently instead of
+// re-deriving segment boundaries from the filename's own byte ranges.
+// ranges is in byte offsets into the full fileName, as returned
+// alongside it.
+func pathSegmentMatches(fileName string, ranges []byteRange, queryTermCount int) []Match {
+	var matches []Match
+	start := 0
+	for {
+		end := strings.IndexByte(fileName[start:], '/')
+		segEnd := len(fileName)
+		if end >= 0 {
+			segEnd = start + end
+		}
+		matches = append(matches, newMatch(fileName[start:segEnd], rangesInSegment(ranges, start, segEnd), queryTermCount))
+		if end < 0 {
+			return matches
+		}
+		start = segEnd + 1
+	}
+}
+
+// rangesInSegment returns the subset of ranges that fall entirely
+// within the byte span [segStart, segEnd), rebased to be relative to
+// segStart.
+func rangesInSegment(ranges []byteRange, segStart, segEnd int) []byteRange {
+	var out []byteRange
+	for _, rg := range ranges {
+		if rg.start >= segStart && rg.end <= segEnd {
+			out = append(out, byteRange{start: rg.start - segStart, end: rg.end - segStart, word: rg.word})
+		}
+	}
+	return out
+}
+
+// MatchLevel describes how thoroughly the query matched a single
+// highlighted attribute (filename, path segment, line content, or
+// symbol name).
+type MatchLevel string
+
+const (
+	MatchLevelNone    MatchLevel = "none"
+	MatchLevelPartial MatchLevel = "partial"
+	MatchLevelFull    MatchLevel = "full"
+)
+
+// Match is one highlighted fragment of an attribute, in the
+// structured REST response format selected by ?format=structured or
+// an "Accept: application/vnd.zoekt.v2+json" header. It mirrors the
+// native zoekt match data so that a frontend doesn't have to
+// reimplement zoekt's fragment math to render a hit card.
+type Match struct {
+	Value            string     `json:"value"`
+	MatchLevel       MatchLevel `json:"matchLevel"`
+	FullyHighlighted *bool      `json:"fullyHighlighted,omitempty"`
+	MatchedWords     []string   `json:"matchedWords,omitempty"`
+	Before           string     `json:"before"`
+	After            string     `json:"after"`
+}
+
+// byteRange is a single highlighted span, in byte offsets into value.
+type byteRange struct {
+	start, end int
+	word       string
+}
+
+// contextWindow bounds how much of value surrounds a hit is returned
+// in Match.Before/Match.After.
+const contextWindow = 40
+
+// newMatch builds the structured Match for value, given the byte
+// ranges that matched query terms and the total number of terms in
+// the query. ranges need not be sorted or deduplicated.
+func newMatch(value string, ranges []byteRange, queryTermCount int) Match {
+	if len(ranges) == 0 {
+		return Match{Value: value, MatchLevel: MatchLevelNone, Before: "", After: ""}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	words := map[string]struct{}{}
+	for _, rg := range ranges {
+		words[rg.word] = struct{}{}
+	}
+	matchedWords := make([]string, 0, len(words))
+	for w := range words {
+		matchedWords = append(matchedWords, w)
+	}
+	sort.Strings(matchedWords)
+
+	level := MatchLevelPartial
+	if queryTermCount > 0 && len(words) >= queryTermCount {
+		level = MatchLevelFull
+	}
+
+	first, last := ranges[0], ranges[len(ranges)-1]
+	fullyHighlighted := rangesCoverWithoutGaps(ranges, len(value))
+
+	before := truncateSuffix(value[:first.start], contextWindow)
+	after := truncatePrefix(value[last.end:], contextWindow)
+
+	return Match{
+		Value:            value,
+		MatchLevel:       level,
+		FullyHighlighted: &fullyHighlighted,
+		MatchedWords:     matchedWords,
+		Before:           before,
+		After:            after,
+	}
+}
+
+// rangesCoverWithoutGaps reports whether ranges, sorted by start,
+// start at 0 and jointly cover every byte of a value valueLen bytes
+// long, without a gap between any two consecutive (possibly
+// overlapping) ranges. Used to decide FullyHighlighted: a value like
+// "international" with hits on "inter" and "onal" is NOT fully
+// highlighted, since "nati" in between is unmatched.
+func rangesCoverWithoutGaps(ranges []byteRange, valueLen int) bool {
+	if ranges[0].start != 0 {
+		return false
+	}
+	end := ranges[0].end
+	for _, rg := range ranges[1:] {
+		if rg.start > end {
+			return false
+		}
+		if rg.end > end {
+			end = rg.end
+		}
+	}
+	return end == valueLen
+}
+
+// truncateSuffix returns the longest suffix of s no longer than n
+// bytes that starts on a UTF-8 rune boundary, so a multi-byte rune at
+// the cut point is never split.
+func truncateSuffix(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	start := len(s) - n
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+	return s[start:]
+}
+
+// truncatePrefix returns the longest prefix of s no longer than n
+// bytes that ends on a UTF-8 rune boundary, so a multi-byte rune at
+// the cut point is never split.
+func truncatePrefix(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	end := n
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
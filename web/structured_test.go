@@ -0,0 +1,91 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNewMatchFullyHighlightedRequiresNoGap(t *testing.T) {
+	// "inter" (0-5) and "onal" (9-13) leave "nati" (5-9) unmatched, so
+	// "international" is not fully highlighted even though the first
+	// and last ranges span the whole word.
+	value := "international"
+	ranges := []byteRange{
+		{start: 0, end: 5, word: "inter"},
+		{start: 9, end: 13, word: "onal"},
+	}
+
+	m := newMatch(value, ranges, 1)
+	if m.FullyHighlighted == nil || *m.FullyHighlighted {
+		t.Fatalf("expected FullyHighlighted=false for a gapped match, got %v", m.FullyHighlighted)
+	}
+}
+
+func TestNewMatchFullyHighlightedNoGap(t *testing.T) {
+	value := "foobar"
+	ranges := []byteRange{
+		{start: 0, end: 3, word: "foo"},
+		{start: 3, end: 6, word: "bar"},
+	}
+
+	m := newMatch(value, ranges, 1)
+	if m.FullyHighlighted == nil || !*m.FullyHighlighted {
+		t.Fatalf("expected FullyHighlighted=true for adjacent ranges covering the value, got %v", m.FullyHighlighted)
+	}
+}
+
+func TestNewMatchTruncationRespectsUTF8Boundaries(t *testing.T) {
+	// 'é' is 2 bytes. The 61 bytes on either side of "bar" exceed
+	// contextWindow, so Before and After are truncated, and a plain
+	// 40-byte cut would land inside an 'é'; truncation must not split it.
+	value := strings.Repeat("é", 30) + " bar " + strings.Repeat("é", 30)
+	ranges := []byteRange{{start: 61, end: 64, word: "bar"}}
+
+	m := newMatch(value, ranges, 1)
+	if !utf8.ValidString(m.Before) || !utf8.ValidString(m.After) {
+		t.Fatalf("truncated Before/After must stay valid UTF-8: before=%q after=%q", m.Before, m.After)
+	}
+}
+
+func TestPathSegmentMatches(t *testing.T) {
+	fileName := "web/structured.go"
+	// Hit on "struct" inside the second segment, at bytes 4-10 of
+	// fileName ("web/" is 4 bytes).
+	ranges := []byteRange{{start: 4, end: 10, word: "struct"}}
+
+	segments := pathSegmentMatches(fileName, ranges, 1)
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want 2: %+v", len(segments), segments)
+	}
+	if segments[0].Value != "web" || segments[0].MatchLevel != MatchLevelNone {
+		t.Fatalf("segment 0 = %+v, want unmatched \"web\"", segments[0])
+	}
+	if segments[1].Value != "structured.go" || segments[1].MatchLevel == MatchLevelNone {
+		t.Fatalf("segment 1 = %+v, want a match on \"structured.go\"", segments[1])
+	}
+	if len(segments[1].MatchedWords) != 1 || segments[1].MatchedWords[0] != "struct" {
+		t.Fatalf("segment 1 MatchedWords = %v, want [struct]", segments[1].MatchedWords)
+	}
+}
+
+func TestPathSegmentMatchesNoSeparator(t *testing.T) {
+	segments := pathSegmentMatches("README.md", nil, 1)
+	if len(segments) != 1 || segments[0].Value != "README.md" {
+		t.Fatalf("pathSegmentMatches(\"README.md\") = %+v, want a single \"README.md\" segment", segments)
+	}
+}
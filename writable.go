@@ -0,0 +1,225 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+	"os"
+)
+
+// Writable is a handle on a shard that supports patching in a small
+// number of file changes without rebuilding the shard from scratch.
+// Changes made through ReplaceFile and RemoveFile are held in a
+// separate patch section; Compact merges the patch section back into
+// the main postings and drops tombstoned documents.
+//
+// Writable is not safe for concurrent use.
+type Writable struct {
+	path string
+	b    *IndexBuilder
+
+	// nameToDoc maps a known document name to its docID, so
+	// ReplaceFile and RemoveFile can find (and tombstone) a
+	// previous version of a file.
+	nameToDoc map[string]uint32
+
+	// tombstones holds the docIDs of documents that have been
+	// replaced or removed since the shard was opened (or last
+	// compacted), across every branch. Search must skip these.
+	tombstones map[uint32]struct{}
+
+	// patch holds postings and documents contributed by
+	// ReplaceFile/RemoveFile. Search reads this in addition to the
+	// primary postings built at shard creation time. docIDs here
+	// continue the numbering of the shard's primary documents.
+	patch *IndexBuilder
+}
+
+// OpenWritable opens the shard at path for incremental updates. repo
+// supplies the shard's branch set (and subrepo map): ReplaceFile
+// rejects any branch name not present in repo.Branches, the same way
+// IndexBuilder.Add does, so repo must list every branch callers will
+// pass to ReplaceFile. repo may be nil for a shard that never passes
+// branches to ReplaceFile.
+//
+// There is not yet a shard reader in this package, so OpenWritable
+// cannot load an existing shard's documents into memory. Rather than
+// silently behaving as if the shard were empty -- which would make
+// Compact drop every on-disk document the first time it runs --
+// OpenWritable refuses to open a path that already holds shard data.
+// It is only usable today for a shard that is being created fresh:
+// create (or truncate) path, call OpenWritable, then ReplaceFile and
+// Compact as usual.
+//
+// TODO(zoekt): once a shard reader exists in this package, OpenWritable
+// should use it to load the shard's existing documents into b (and
+// populate nameToDoc for them) before returning, and the restriction
+// on non-empty paths below should go away.
+func OpenWritable(path string, repo *Repository) (*Writable, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("zoekt: %s is a directory", path)
+	}
+	if fi.Size() > 0 {
+		return nil, fmt.Errorf("zoekt: %s already contains shard data, which OpenWritable cannot yet load; "+
+			"see the OpenWritable doc comment", path)
+	}
+
+	b, err := NewIndexBuilder(repo)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := NewIndexBuilder(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writable{
+		path:       path,
+		b:          b,
+		patch:      patch,
+		nameToDoc:  map[string]uint32{},
+		tombstones: map[uint32]struct{}{},
+	}, nil
+}
+
+// docID returns the numbering of the next document added to w,
+// counting both the primary shard and anything already patched in.
+func (w *Writable) docID() uint32 {
+	return uint32(len(w.b.files) + len(w.patch.files))
+}
+
+// ReplaceFile adds (or replaces) the document for name. If name was
+// already present, either in the primary shard or in a previous
+// patch, its old docID is tombstoned in every branch before the new
+// version is appended to the patch section.
+func (w *Writable) ReplaceFile(name string, content []byte, branches []string) error {
+	if old, ok := w.nameToDoc[name]; ok {
+		w.tombstones[old] = struct{}{}
+	}
+
+	id := w.docID()
+	if err := w.patch.Add(Document{
+		Name:     name,
+		Content:  content,
+		Branches: branches,
+	}); err != nil {
+		return err
+	}
+
+	w.nameToDoc[name] = id
+	return nil
+}
+
+// RemoveFile tombstones the document for name, if one is known to w.
+// It is not an error to remove a file that isn't present.
+func (w *Writable) RemoveFile(name string) error {
+	id, ok := w.nameToDoc[name]
+	if !ok {
+		return nil
+	}
+	w.tombstones[id] = struct{}{}
+	delete(w.nameToDoc, name)
+	return nil
+}
+
+// Compact rebuilds the shard's in-memory IndexBuilder from scratch by
+// replaying every surviving (non-tombstoned) document, from the
+// primary builder and then the patch, through a fresh IndexBuilder.
+// This naturally drops tombstoned documents' postings, renumbers
+// docIDs densely from zero, and recomputes every piece of per-builder
+// offset bookkeeping (endByte, endRunes, runeOffsets, subRepoTree,
+// subRepoDocs) from the new document list, rather than trying to
+// patch that bookkeeping up after the fact.
+//
+// Compact should be called periodically; between calls, search pays
+// for walking the (small) patch section and the tombstone set.
+func (w *Writable) Compact() error {
+	// Finish both builders so any postings segments they spilled to
+	// disk are merged and their temporary files removed. The replay
+	// below reads names and content from fileNames and files, which
+	// stay in memory whether or not postings were spilled.
+	if err := w.b.Finish(); err != nil {
+		return err
+	}
+	if err := w.patch.Finish(); err != nil {
+		return err
+	}
+
+	var maxInMemoryBytes int64
+	if w.b.contents.budget != nil {
+		maxInMemoryBytes = w.b.contents.budget.max
+	}
+
+	repo := w.b.repo
+	next, err := NewIndexBuilderWithOptions(&repo, BuilderOptions{MaxInMemoryBytes: maxInMemoryBytes})
+	if err != nil {
+		return err
+	}
+
+	nameToDoc := map[string]uint32{}
+	var origID uint32
+	for _, src := range []*IndexBuilder{w.b, w.patch} {
+		idxToSubRepo := make(map[uint32]string, len(src.subRepoIndices))
+		for path, idx := range src.subRepoIndices {
+			idxToSubRepo[idx] = path
+		}
+
+		for i := range src.files {
+			id := origID
+			origID++
+
+			if _, dead := w.tombstones[id]; dead {
+				continue
+			}
+
+			doc := Document{
+				Name:              string(src.fileNames[i].data),
+				Content:           src.files[i].data,
+				Branches:          branchNames(src.repo.Branches, src.branchMasks[i]),
+				SubRepositoryPath: idxToSubRepo[src.subRepos[i]],
+				Symbols:           src.docSections[i],
+			}
+			if err := next.Add(doc); err != nil {
+				return err
+			}
+			nameToDoc[doc.Name] = uint32(len(next.files) - 1)
+		}
+	}
+
+	w.b = next
+	w.patch, err = NewIndexBuilder(&repo)
+	if err != nil {
+		return err
+	}
+	w.nameToDoc = nameToDoc
+	w.tombstones = map[uint32]struct{}{}
+	return nil
+}
+
+// branchNames expands a branch bitmask back into the branch names it
+// selects from branches.
+func branchNames(branches []Branch, mask uint32) []string {
+	var names []string
+	for i, br := range branches {
+		if mask&(uint32(1)<<uint(i)) != 0 {
+			names = append(names, br.Name)
+		}
+	}
+	return names
+}
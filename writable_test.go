@@ -0,0 +1,139 @@
+// Copyright 2016 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newEmptyShardFile(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shard.zoekt")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return path
+}
+
+func TestOpenWritableRejectsExistingShard(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shard.zoekt")
+	if err := ioutil.WriteFile(path, []byte("not empty"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenWritable(path, nil); err == nil {
+		t.Fatal("expected OpenWritable to refuse a non-empty shard path")
+	}
+}
+
+func TestCompactDropsTombstonesAndRenumbers(t *testing.T) {
+	path := newEmptyShardFile(t)
+	w, err := OpenWritable(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.ReplaceFile("a.go", []byte("package a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReplaceFile("b.go", []byte("package b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReplaceFile("c.go", []byte("package c"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.RemoveFile("b.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.tombstones) != 0 {
+		t.Fatalf("expected no tombstones after Compact, got %v", w.tombstones)
+	}
+	if len(w.b.files) != 2 {
+		t.Fatalf("expected 2 surviving documents after Compact, got %d", len(w.b.files))
+	}
+
+	names := map[string]bool{}
+	for _, f := range w.b.fileNames {
+		names[string(f.data)] = true
+	}
+	if names["b.go"] {
+		t.Fatalf("removed file b.go should not survive Compact: %v", names)
+	}
+	if !names["a.go"] || !names["c.go"] {
+		t.Fatalf("expected a.go and c.go to survive Compact, got %v", names)
+	}
+
+	// Offset bookkeeping must describe exactly the surviving
+	// documents: one endRunes entry per file, strictly increasing,
+	// and endByte equal to the sum of their contents.
+	if len(w.b.contents.endRunes) != len(w.b.files) {
+		t.Fatalf("endRunes length %d does not match file count %d", len(w.b.contents.endRunes), len(w.b.files))
+	}
+	wantEndByte := uint32(len("package a") + len("package c"))
+	if w.b.contents.endByte != wantEndByte {
+		t.Fatalf("endByte = %d, want %d", w.b.contents.endByte, wantEndByte)
+	}
+
+	// The shard must still be usable afterwards.
+	if err := w.ReplaceFile("d.go", []byte("package d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.b.files) != 3 {
+		t.Fatalf("expected 3 surviving documents after second Compact, got %d", len(w.b.files))
+	}
+}
+
+func TestReplaceFileWithBranches(t *testing.T) {
+	path := newEmptyShardFile(t)
+	repo := &Repository{Branches: []Branch{{Name: "master"}, {Name: "release"}}}
+	w, err := OpenWritable(path, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.ReplaceFile("a.go", []byte("package a"), []string{"master"}); err != nil {
+		t.Fatalf("ReplaceFile with a known branch should succeed: %v", err)
+	}
+	if err := w.ReplaceFile("b.go", []byte("package b"), []string{"master", "release"}); err != nil {
+		t.Fatalf("ReplaceFile with known branches should succeed: %v", err)
+	}
+	if err := w.ReplaceFile("c.go", []byte("package c"), []string{"nope"}); err == nil {
+		t.Fatal("expected ReplaceFile to reject an unknown branch name")
+	}
+
+	// The branch set must survive Compact, since it rebuilds both w.b
+	// and w.patch from scratch.
+	if err := w.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ReplaceFile("d.go", []byte("package d"), []string{"release"}); err != nil {
+		t.Fatalf("ReplaceFile with a known branch should still succeed after Compact: %v", err)
+	}
+}